@@ -3,21 +3,94 @@ package datadog
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"github.com/rcrowley/go-metrics"
-	"io"
+	"math/rand"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 const (
-	ENDPOINT        = "https://app.datadoghq.com/api"
-	SERIES_ENDPIONT = "/v1/series"
+	SERIES_ENDPIONT    = "/v1/series"
+	SERIES_V2_ENDPOINT = "/v2/series"
+	EVENTS_ENDPOINT    = "/v1/events"
+	CHECK_RUN_ENDPOINT = "/v1/check_run"
+)
+
+// Datadog site identifiers, for use with Client.Site. They select which
+// regional intake a Client talks to; see
+// https://docs.datadoghq.com/getting_started/site/.
+const (
+	SiteUS1 = "datadoghq.com"
+	SiteUS3 = "us3.datadoghq.com"
+	SiteUS5 = "us5.datadoghq.com"
+	SiteEU  = "datadoghq.eu"
+	SiteGov = "ddog-gov.com"
+)
+
+const (
+	// DefaultRequestTimeout is the HTTP client timeout that New and NewV2
+	// configure on the Clients they return.
+	DefaultRequestTimeout = 10 * time.Second
+
+	// DefaultMaxChunkBytes caps the uncompressed JSON body of a single
+	// /v1/series request. Datadog's intake rejects bodies much larger than
+	// this, so PostSeries splits a large report into several requests.
+	DefaultMaxChunkBytes = 3200000
+
+	// DefaultGzipThreshold is the uncompressed body size above which a
+	// request is gzip-encoded.
+	DefaultGzipThreshold = 32 * 1024
+
+	// DefaultMaxRetries is how many additional attempts a request gets
+	// after a 429, 5xx, or network error, before its error is surfaced.
+	DefaultMaxRetries = 3
+)
+
+// Service check statuses, as defined by Datadog's `/v1/check_run` API.
+const (
+	StatusOk = iota
+	StatusWarning
+	StatusCritical
+	StatusUnknown
 )
 
 type Client struct {
 	Host   string
 	ApiKey string
+
+	// AppKey is sent as the DD-APPLICATION-KEY header when set. It isn't
+	// needed by any of the write APIs this Client calls today, but is
+	// accepted for read APIs built on top of it in the future.
+	AppKey string
+
+	// Site selects which Datadog regional intake this Client talks to, e.g.
+	// SiteEU. If empty, it falls back to SiteUS1.
+	Site string
+
+	// HTTPClient is used for every request this Client makes. If nil, it
+	// falls back to http.DefaultClient.
+	HTTPClient *http.Client
+
+	// MaxChunkBytes caps the uncompressed JSON body of a single request. If
+	// zero, it falls back to DefaultMaxChunkBytes.
+	MaxChunkBytes int
+
+	// GzipThreshold is the uncompressed body size above which a request is
+	// gzip-encoded. If zero, it falls back to DefaultGzipThreshold.
+	GzipThreshold int
+
+	// MaxRetries is how many additional attempts a request gets after a
+	// 429, 5xx, or network error. If zero, it falls back to
+	// DefaultMaxRetries.
+	MaxRetries int
+
+	// v2 targets this Client's series posts at the /v2/series endpoint,
+	// using its richer points/resources shape. Set by NewV2.
+	v2 bool
 }
 
 type seriesMessage struct {
@@ -32,51 +105,400 @@ type Series struct {
 	Tags   []string         `json:"tags,omitempty"`
 }
 
+// ServiceCheck describes the result of a single check, as posted to
+// Datadog's `/v1/check_run` API. `Status` should be one of `StatusOk`,
+// `StatusWarning`, `StatusCritical`, or `StatusUnknown`.
+type ServiceCheck struct {
+	Check     string   `json:"check"`
+	HostName  string   `json:"host_name,omitempty"`
+	Status    int      `json:"status"`
+	Timestamp int64    `json:"timestamp,omitempty"`
+	Message   string   `json:"message,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
 // Create a new Datadog client. In EC2, datadog expects the hostname to be the
 // instance ID rather than `gethostname(2)`. However, that value can be obtained
-// with `os.Hostname()`.
+// with `os.Hostname()`. It targets the /v1/series endpoint on SiteUS1; set
+// Site to use a different regional intake.
 func New(host, apiKey string) *Client {
 	return &Client{
-		Host:   host,
-		ApiKey: apiKey,
+		Host:          host,
+		ApiKey:        apiKey,
+		HTTPClient:    &http.Client{Timeout: DefaultRequestTimeout},
+		MaxChunkBytes: DefaultMaxChunkBytes,
+		GzipThreshold: DefaultGzipThreshold,
+		MaxRetries:    DefaultMaxRetries,
+	}
+}
+
+// Create a new Datadog client targeting the /v2/series endpoint, which
+// requires an explicit site and accepts an optional application key for
+// future read APIs. PostSeries on the returned Client serializes points in
+// the v2 series shape instead of the v1 shape New's Client uses.
+func NewV2(site, apiKey, appKey string) *Client {
+	return &Client{
+		Site:          site,
+		ApiKey:        apiKey,
+		AppKey:        appKey,
+		HTTPClient:    &http.Client{Timeout: DefaultRequestTimeout},
+		MaxChunkBytes: DefaultMaxChunkBytes,
+		GzipThreshold: DefaultGzipThreshold,
+		MaxRetries:    DefaultMaxRetries,
+		v2:            true,
 	}
 }
 
-// Gets an authenticated URL to POST series data to. In Datadog's examples, this
-// value is 'https://app.datadoghq.com/api/v1/series?api_key=9775a026f1ca7d1...'
+// site returns c.Site, falling back to SiteUS1 if it's unset.
+func (c *Client) site() string {
+	if c.Site != "" {
+		return c.Site
+	}
+	return SiteUS1
+}
+
+// baseUrl returns this Client's API root, e.g. 'https://api.datadoghq.eu/api'.
+func (c *Client) baseUrl() string {
+	return "https://api." + c.site() + "/api"
+}
+
+// Gets the URL to POST series data to. The API key is not included in the
+// URL; it's sent as the DD-API-KEY header instead.
 func (c *Client) SeriesUrl() string {
-	return ENDPOINT + SERIES_ENDPIONT + "?api_key=" + c.ApiKey
+	if c.v2 {
+		return c.baseUrl() + SERIES_V2_ENDPOINT
+	}
+	return c.baseUrl() + SERIES_ENDPIONT
+}
+
+// Posts an array of series data to the Datadog API. Large reports are split
+// into chunks under MaxChunkBytes and posted independently, so one oversized
+// or failing chunk doesn't sink the rest; any chunks that still fail after
+// retrying are returned together as a *MultiError rather than aborting on
+// the first failure, with MultiError.Failed holding exactly the series from
+// the chunks that didn't make it, so callers can retry only those instead of
+// the whole report.
+func (c *Client) PostSeries(series []*Series) error {
+	errs := &MultiError{}
+	for _, chunk := range chunkSeries(series, c.maxChunkBytes()) {
+		bs, err := c.marshalSeries(chunk)
+		if err != nil {
+			errs.Errors = append(errs.Errors, err)
+			errs.Failed = append(errs.Failed, chunk...)
+			continue
+		}
+		if err := c.post(c.SeriesUrl(), bs); err != nil {
+			errs.Errors = append(errs.Errors, err)
+			errs.Failed = append(errs.Failed, chunk...)
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// marshalSeries serializes series in whichever shape this Client's target
+// endpoint expects.
+func (c *Client) marshalSeries(series []*Series) ([]byte, error) {
+	if c.v2 {
+		return marshalSeriesMessageV2(series)
+	}
+	return marshalSeriesMessage(series)
+}
+
+func marshalSeriesMessage(series []*Series) ([]byte, error) {
+	return json.Marshal(&seriesMessage{series})
+}
+
+// seriesV2Message is the /v2/series request body.
+type seriesV2Message struct {
+	Series []*seriesV2 `json:"series"`
+}
+
+// Metric type enum values for seriesV2.Type, as defined by Datadog's
+// /v2/series API.
+const (
+	seriesV2TypeUnspecified = iota
+	seriesV2TypeCount
+	seriesV2TypeRate
+	seriesV2TypeGauge
+)
+
+type seriesV2 struct {
+	Metric    string             `json:"metric"`
+	Type      int                `json:"type"`
+	Points    []seriesV2Point    `json:"points"`
+	Resources []seriesV2Resource `json:"resources,omitempty"`
+	Tags      []string           `json:"tags,omitempty"`
+}
+
+type seriesV2Point struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+type seriesV2Resource struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+func marshalSeriesMessageV2(series []*Series) ([]byte, error) {
+	v2 := make([]*seriesV2, len(series))
+	for i, s := range series {
+		v2[i] = toSeriesV2(s)
+	}
+	return json.Marshal(&seriesV2Message{v2})
+}
+
+func toSeriesV2(s *Series) *seriesV2 {
+	points := make([]seriesV2Point, len(s.Points))
+	for i, p := range s.Points {
+		points[i] = seriesV2Point{
+			Timestamp: toInt64(p[0]),
+			Value:     toFloat64(p[1]),
+		}
+	}
+
+	var resources []seriesV2Resource
+	if s.Host != "" {
+		resources = []seriesV2Resource{{Name: s.Host, Type: "host"}}
+	}
+
+	return &seriesV2{
+		Metric:    s.Metric,
+		Type:      seriesV2Type(s.Type),
+		Points:    points,
+		Resources: resources,
+		Tags:      s.Tags,
+	}
+}
+
+// seriesV2Type maps a v1 Series.Type string to its v2 metric type enum.
+func seriesV2Type(t string) int {
+	switch t {
+	case "counter":
+		return seriesV2TypeCount
+	case "rate":
+		return seriesV2TypeRate
+	case "gauge":
+		return seriesV2TypeGauge
+	default:
+		return seriesV2TypeUnspecified
+	}
+}
+
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	case float64:
+		return int64(n)
+	default:
+		return 0
+	}
 }
 
-// Posts an array of series data to the Datadog API. The API expects an object,
-// not an array, so it will be wrapped in a `seriesMessage` with a single
-// `series` field.
-func (c *Client) PostSeries(series []*Series) (err error) {
-	body, err := c.seriesReader(series)
+func toFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case int64:
+		return float64(n)
+	case int:
+		return float64(n)
+	default:
+		return 0
+	}
+}
+
+// chunkSeries splits series into groups whose marshaled JSON stays under
+// maxBytes, so a single report can't be rejected for exceeding Datadog's
+// intake size limit. A single `Series` larger than maxBytes still gets its
+// own chunk, since it can't be split further.
+func chunkSeries(series []*Series, maxBytes int) [][]*Series {
+	if len(series) == 0 {
+		return nil
+	}
+
+	chunks := make([][]*Series, 0, 1)
+	chunk := make([]*Series, 0)
+	size := 0
+	for _, s := range series {
+		bs, err := json.Marshal(s)
+		if err != nil {
+			continue
+		}
+		if len(chunk) > 0 && size+len(bs) > maxBytes {
+			chunks = append(chunks, chunk)
+			chunk = make([]*Series, 0)
+			size = 0
+		}
+		chunk = append(chunk, s)
+		size += len(bs)
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// Gets the URL to POST event data to. The API key is not included in the
+// URL; it's sent as the DD-API-KEY header instead.
+func (c *Client) EventsUrl() string {
+	return c.baseUrl() + EVENTS_ENDPOINT
+}
+
+// Posts a single event to the Datadog API.
+func (c *Client) PostEvent(e *Event) error {
+	bs, err := json.Marshal(e)
 	if err != nil {
 		return err
 	}
-	resp, err := http.Post(c.SeriesUrl(), "application/json", body)
+	return c.post(c.EventsUrl(), bs)
+}
+
+// Gets the URL to POST service check results to. The API key is not
+// included in the URL; it's sent as the DD-API-KEY header instead.
+func (c *Client) CheckRunUrl() string {
+	return c.baseUrl() + CHECK_RUN_ENDPOINT
+}
+
+// Posts a single service check result to the Datadog API.
+func (c *Client) PostServiceCheck(sc *ServiceCheck) error {
+	bs, err := json.Marshal(sc)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if !(resp.StatusCode == 200 || resp.StatusCode == 202) {
-		return fmt.Errorf("Bad Datadog response: '%s'", resp.Status)
+	return c.post(c.CheckRunUrl(), bs)
+}
+
+// POSTs the JSON-encoded bs to url, expecting the 200 or 202 that the
+// Datadog API returns on success. A 429 or 5xx response, or a network error,
+// is retried up to MaxRetries times with exponential backoff and jitter,
+// honoring a `Retry-After` header when present. Bodies larger than
+// GzipThreshold are gzip-encoded.
+func (c *Client) post(url string, bs []byte) error {
+	var lastErr error
+	for attempt := 0; attempt <= c.maxRetries(); attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff(attempt))
+		}
+
+		resp, err := c.doPost(url, bs)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode == 200 || resp.StatusCode == 202 {
+			resp.Body.Close()
+			return nil
+		}
+
+		retryable := resp.StatusCode == 429 || resp.StatusCode >= 500
+		retryAfter := retryAfterDelay(resp.Header.Get("Retry-After"))
+		resp.Body.Close()
+
+		lastErr = fmt.Errorf("Bad Datadog response: '%s'", resp.Status)
+		if !retryable {
+			return lastErr
+		}
+		if retryAfter > 0 {
+			time.Sleep(retryAfter)
+		}
 	}
-	return
+	return lastErr
 }
 
-// Serializes an array of `Series` to JSON. The array will be wrapped in a
-// `seriesMessage`, changing the serialized type from an array to an object with
-// a single `series` field.
-func (c *Client) seriesReader(series []*Series) (io.Reader, error) {
-	msg := &seriesMessage{series}
-	bs, err := json.Marshal(msg)
+// doPost issues a single POST attempt, gzip-encoding bs first if it's larger
+// than GzipThreshold.
+func (c *Client) doPost(url string, bs []byte) (*http.Response, error) {
+	body := bytes.NewReader(bs)
+	encoding := ""
+	if len(bs) > c.gzipThreshold() {
+		gz, err := gzipBytes(bs)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(gz)
+		encoding = "gzip"
+	}
+
+	req, err := http.NewRequest("POST", url, body)
 	if err != nil {
 		return nil, err
 	}
-	return bytes.NewBuffer(bs), nil
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("DD-API-KEY", c.ApiKey)
+	if c.AppKey != "" {
+		req.Header.Set("DD-APPLICATION-KEY", c.AppKey)
+	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	return c.httpClient().Do(req)
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) maxChunkBytes() int {
+	if c.MaxChunkBytes > 0 {
+		return c.MaxChunkBytes
+	}
+	return DefaultMaxChunkBytes
+}
+
+func (c *Client) gzipThreshold() int {
+	if c.GzipThreshold > 0 {
+		return c.GzipThreshold
+	}
+	return DefaultGzipThreshold
+}
+
+func (c *Client) maxRetries() int {
+	if c.MaxRetries > 0 {
+		return c.MaxRetries
+	}
+	return DefaultMaxRetries
+}
+
+func gzipBytes(bs []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(bs); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// backoff returns the exponential delay before retry attempt n (1-indexed),
+// plus up to an equal amount of jitter, so a fleet of clients retrying
+// after an outage doesn't thunder back in lockstep.
+func backoff(attempt int) time.Duration {
+	base := (1 << uint(attempt-1)) * 100 * time.Millisecond
+	return base + time.Duration(rand.Int63n(int64(base)+1))
+}
+
+// retryAfterDelay parses a `Retry-After` header's value as a number of
+// seconds, returning zero if it's absent or in the HTTP-date form this
+// client doesn't support.
+func retryAfterDelay(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	secs, err := strconv.Atoi(header)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
 }
 
 // Create a `MetricsReporter` for the given metrics reporter. The returned
@@ -1,9 +1,14 @@
 package datadog
 
 import (
+	"compress/gzip"
+	"encoding/json"
 	"io/ioutil"
 	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
 )
 
@@ -21,10 +26,22 @@ func (s *ClientSuite) SetUpTest(c *C) {
 func (s *ClientSuite) TestSeriesEndpoint(c *C) {
 	client.ApiKey = "secret"
 	c.Check(client.SeriesUrl(), Equals,
-		"https://app.datadoghq.com/api/v1/series?api_key=secret")
+		"https://api.datadoghq.com/api/v1/series")
 }
 
-func (s *ClientSuite) TestSingleSeriesReader(c *C) {
+func (s *ClientSuite) TestSeriesEndpointUsesSite(c *C) {
+	client.Site = SiteEU
+	c.Check(client.SeriesUrl(), Equals,
+		"https://api.datadoghq.eu/api/v1/series")
+}
+
+func (s *ClientSuite) TestV2SeriesEndpoint(c *C) {
+	v2 := NewV2(SiteUS3, "secret", "")
+	c.Check(v2.SeriesUrl(), Equals,
+		"https://api.us3.datadoghq.com/api/v2/series")
+}
+
+func (s *ClientSuite) TestMarshalSeries(c *C) {
 	series := &Series{
 		Metric: "foo.bar.baz",
 		Points: [][2]interface{}{[2]interface{}{1346340794, 66.6}},
@@ -33,16 +50,245 @@ func (s *ClientSuite) TestSingleSeriesReader(c *C) {
 		Tags:   []string{"one", "two", "three"},
 	}
 
-	reader, err := client.seriesReader([]*Series{series})
-	c.Check(err, IsNil)
+	bs, err := client.marshalSeries([]*Series{series})
+	c.Assert(err, IsNil)
 
-	b, err := ioutil.ReadAll(reader)
-	c.Check(err, IsNil)
-
-	body := string(b)
+	body := string(bs)
 	c.Check(strings.Index(body, `"metric":"foo.bar.baz"`), Not(Equals), -1)
 	c.Check(strings.Index(body, `"points":[[1346340794,66.6]]`), Not(Equals), -1)
 	c.Check(strings.Index(body, `"type":"gauge"`), Not(Equals), -1)
 	c.Check(strings.Index(body, `"host":"hostname"`), Not(Equals), -1)
 	c.Check(strings.Index(body, `"tags":["one","two","three"]`), Not(Equals), -1)
 }
+
+func (s *ClientSuite) TestEventsEndpoint(c *C) {
+	client.ApiKey = "secret"
+	c.Check(client.EventsUrl(), Equals,
+		"https://api.datadoghq.com/api/v1/events")
+}
+
+func (s *ClientSuite) TestPostEventSendsMarshaledEvent(c *C) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client.HTTPClient = redirectingClient(server.URL)
+
+	event := &Event{
+		Title:     "deploy started",
+		Text:      "deploying build 42",
+		Host:      "hostname",
+		Tags:      []string{"env:prod"},
+		AlertType: "info",
+	}
+	c.Assert(client.PostEvent(event), IsNil)
+
+	got := string(body)
+	c.Check(strings.Index(got, `"title":"deploy started"`), Not(Equals), -1)
+	c.Check(strings.Index(got, `"text":"deploying build 42"`), Not(Equals), -1)
+	c.Check(strings.Index(got, `"host":"hostname"`), Not(Equals), -1)
+	c.Check(strings.Index(got, `"tags":["env:prod"]`), Not(Equals), -1)
+	c.Check(strings.Index(got, `"alert_type":"info"`), Not(Equals), -1)
+}
+
+func (s *ClientSuite) TestCheckRunEndpoint(c *C) {
+	client.ApiKey = "secret"
+	c.Check(client.CheckRunUrl(), Equals,
+		"https://api.datadoghq.com/api/v1/check_run")
+}
+
+func (s *ClientSuite) TestPostServiceCheckSendsMarshaledCheck(c *C) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client.HTTPClient = redirectingClient(server.URL)
+
+	check := &ServiceCheck{
+		Check:    "my.check",
+		HostName: "hostname",
+		Status:   StatusCritical,
+		Message:  "connection refused",
+		Tags:     []string{"env:prod"},
+	}
+	c.Assert(client.PostServiceCheck(check), IsNil)
+
+	got := string(body)
+	c.Check(strings.Index(got, `"check":"my.check"`), Not(Equals), -1)
+	c.Check(strings.Index(got, `"host_name":"hostname"`), Not(Equals), -1)
+	c.Check(strings.Index(got, `"status":2`), Not(Equals), -1)
+	c.Check(strings.Index(got, `"message":"connection refused"`), Not(Equals), -1)
+	c.Check(strings.Index(got, `"tags":["env:prod"]`), Not(Equals), -1)
+}
+
+func (s *ClientSuite) TestChunkSeriesSplitsOnMaxBytes(c *C) {
+	series := make([]*Series, 0)
+	for i := 0; i < 5; i++ {
+		series = append(series, &Series{Metric: "my.metric", Type: "gauge"})
+	}
+
+	one, _ := json.Marshal(series[0])
+	chunks := chunkSeries(series, len(one)*2)
+
+	c.Check(chunks, HasLen, 3)
+	c.Check(chunks[0], HasLen, 2)
+	c.Check(chunks[1], HasLen, 2)
+	c.Check(chunks[2], HasLen, 1)
+}
+
+func (s *ClientSuite) TestChunkSeriesOversizedSeriesGetsOwnChunk(c *C) {
+	series := []*Series{
+		{Metric: "small", Type: "gauge"},
+		{Metric: "huge", Type: "gauge", Tags: []string{strings.Repeat("x", 100)}},
+	}
+
+	chunks := chunkSeries(series, 10)
+	c.Check(chunks, HasLen, 2)
+	c.Check(chunks[0], HasLen, 1)
+	c.Check(chunks[1], HasLen, 1)
+}
+
+func (s *ClientSuite) TestChunkSeriesEmpty(c *C) {
+	c.Check(chunkSeries(nil, 100), IsNil)
+}
+
+func (s *ClientSuite) TestPostSeriesReportsOnlyFailedChunkAsFailed(c *C) {
+	var posts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&posts, 1) == 1 {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client.HTTPClient = redirectingClient(server.URL)
+	client.MaxRetries = 0
+	client.MaxChunkBytes = 1
+
+	one := &Series{Metric: "one", Type: "gauge"}
+	two := &Series{Metric: "two", Type: "gauge"}
+	err := client.PostSeries([]*Series{one, two})
+	c.Assert(err, Not(IsNil))
+
+	me, ok := err.(*MultiError)
+	c.Assert(ok, Equals, true)
+	c.Check(me.Failed, HasLen, 1)
+	c.Check(me.Failed[0].Metric, Equals, "two")
+}
+
+func (s *ClientSuite) TestPostRetriesOnServerErrorThenSucceeds(c *C) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client.HTTPClient = server.Client()
+	client.MaxRetries = 3
+	err := client.post(server.URL, []byte(`{}`))
+	c.Assert(err, IsNil)
+	c.Check(atomic.LoadInt32(&attempts), Equals, int32(3))
+}
+
+func (s *ClientSuite) TestPostGivesUpAfterMaxRetries(c *C) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client.HTTPClient = server.Client()
+	client.MaxRetries = 2
+	err := client.post(server.URL, []byte(`{}`))
+	c.Assert(err, Not(IsNil))
+	c.Check(atomic.LoadInt32(&attempts), Equals, int32(3))
+}
+
+func (s *ClientSuite) TestPostDoesNotRetryOnNonRetryableStatus(c *C) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	client.HTTPClient = server.Client()
+	err := client.post(server.URL, []byte(`{}`))
+	c.Assert(err, Not(IsNil))
+	c.Check(atomic.LoadInt32(&attempts), Equals, int32(1))
+}
+
+func (s *ClientSuite) TestPostGzipsLargeBodies(c *C) {
+	var gotEncoding string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotEncoding = r.Header.Get("Content-Encoding")
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client.HTTPClient = server.Client()
+	client.GzipThreshold = 10
+	bs := []byte(strings.Repeat("a", 100))
+	c.Assert(client.post(server.URL, bs), IsNil)
+
+	c.Check(gotEncoding, Equals, "gzip")
+	gz, err := gzip.NewReader(strings.NewReader(string(body)))
+	c.Assert(err, IsNil)
+	decoded, err := ioutil.ReadAll(gz)
+	c.Assert(err, IsNil)
+	c.Check(string(decoded), Equals, string(bs))
+}
+
+func (s *ClientSuite) TestPostSendsApiKeyAndAppKeyAsHeaders(c *C) {
+	var gotApiKey, gotAppKey string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotApiKey = r.Header.Get("DD-API-KEY")
+		gotAppKey = r.Header.Get("DD-APPLICATION-KEY")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client.HTTPClient = server.Client()
+	client.ApiKey = "secret"
+	client.AppKey = "app-secret"
+	c.Assert(client.post(server.URL, []byte(`{}`)), IsNil)
+
+	c.Check(gotApiKey, Equals, "secret")
+	c.Check(gotAppKey, Equals, "app-secret")
+}
+
+func (s *ClientSuite) TestMarshalSeriesV2(c *C) {
+	v2 := NewV2(SiteUS1, "secret", "")
+	series := &Series{
+		Metric: "my.gauge",
+		Points: [][2]interface{}{{int64(1346340794), float64(66.6)}},
+		Type:   "gauge",
+		Host:   "hostname",
+		Tags:   []string{"env:prod"},
+	}
+
+	bs, err := v2.marshalSeries([]*Series{series})
+	c.Assert(err, IsNil)
+
+	body := string(bs)
+	c.Check(strings.Index(body, `"metric":"my.gauge"`), Not(Equals), -1)
+	c.Check(strings.Index(body, `"type":3`), Not(Equals), -1)
+	c.Check(strings.Index(body, `"points":[{"timestamp":1346340794,"value":66.6}]`), Not(Equals), -1)
+	c.Check(strings.Index(body, `"resources":[{"name":"hostname","type":"host"}]`), Not(Equals), -1)
+	c.Check(strings.Index(body, `"tags":["env:prod"]`), Not(Equals), -1)
+}
@@ -0,0 +1,24 @@
+package datadog
+
+// Event describes a Datadog event. It is shared by `Client.PostEvent`, which
+// posts it to the HTTP `/v1/events` endpoint, and `StatsdClient.Event`, which
+// submits it to a local dogstatsd agent over the DogStatsD line protocol.
+type Event struct {
+	Title string `json:"title"`
+	Text  string `json:"text"`
+
+	// DateHappened is a Unix timestamp in seconds. Zero means "now", which is
+	// Datadog's own default.
+	DateHappened int64 `json:"date_happened,omitempty"`
+
+	// Priority is either "normal" or "low".
+	Priority string `json:"priority,omitempty"`
+
+	Host string   `json:"host,omitempty"`
+	Tags []string `json:"tags,omitempty"`
+
+	// AlertType is one of "error", "warning", "info", or "success".
+	AlertType      string `json:"alert_type,omitempty"`
+	AggregationKey string `json:"aggregation_key,omitempty"`
+	SourceTypeName string `json:"source_type_name,omitempty"`
+}
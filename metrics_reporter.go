@@ -5,14 +5,35 @@ package datadog
 import (
 	"github.com/rcrowley/go-metrics"
 	"log"
+	"math"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
+// DefaultMaxBufferedSeries caps how many series `Start` will hold onto
+// across a failed report, so a Datadog outage that outlasts it doesn't grow
+// the buffer without bound.
+const DefaultMaxBufferedSeries = 10000
+
 type MetricsReporter struct {
 	client   *Client
 	registry metrics.Registry
+	statsd   *StatsdClient
+
+	namespace    string
+	globalTags   []string
+	host         string
+	tagExtractor func(string) (string, []string)
+
+	bufferMu          sync.Mutex
+	buffered          []*Series
+	maxBufferedSeries int
+
+	meterCountMu   sync.Mutex
+	lastMeterCount map[string]int64
 }
 
 // Expect the tags in the pattern
@@ -30,9 +51,20 @@ func Reporter(c *Client, r metrics.Registry) *MetricsReporter {
 	}
 }
 
-// Start this reporter in a blocking fashion, pushing series data to datadog at
-// the specified interval. If any errors occur, they will be logged to the
-// default logger, and further updates will continue.
+// WithMaxBufferedSeries overrides how many series `Start` will buffer
+// across a failed report before it starts dropping the oldest ones. It
+// defaults to `DefaultMaxBufferedSeries`. It returns the receiver so it can
+// be chained off `Reporter`.
+func (mr *MetricsReporter) WithMaxBufferedSeries(n int) *MetricsReporter {
+	mr.maxBufferedSeries = n
+	return mr
+}
+
+// Start this reporter in a blocking fashion, pushing series data to datadog
+// at the specified interval. If a tick's report fails, its series are kept
+// and merged into the next tick's report rather than dropped, so a
+// transient Datadog outage coalesces instead of losing data; errors are
+// logged to the default logger and further ticks continue regardless.
 //
 // Scheduling is done with a `time.Ticker`, so non-overlapping intervals are
 // absolute, not based on the finish time of the previous event. They are,
@@ -40,21 +72,245 @@ func Reporter(c *Client, r metrics.Registry) *MetricsReporter {
 func (mr *MetricsReporter) Start(d time.Duration) {
 	ticker := time.NewTicker(d)
 	for _ = range ticker.C {
-		if err := mr.Report(); err != nil {
-			log.Printf("Datadog series error: %s", err.Error())
+		mr.reportTick()
+	}
+}
+
+// reportTick runs a single tick of `Start`. In statsd mode, it simply
+// delegates to `reportStatsd`, since `StatsdClient` already buffers and
+// flushes its own packets. Otherwise, it merges any series buffered from a
+// failed previous tick with this tick's series and posts them; whatever
+// `PostSeries` fails to deliver is re-buffered for the next tick rather than
+// dropped.
+func (mr *MetricsReporter) reportTick() {
+	if mr.statsd != nil {
+		if err := mr.reportStatsd(); err != nil {
+			log.Printf("Datadog statsd error: %s", err.Error())
 		}
+		return
+	}
+
+	series := append(mr.takeBuffered(), mr.Series()...)
+	if err := mr.client.PostSeries(series); err != nil {
+		log.Printf("Datadog series error: %s", err.Error())
+		mr.buffer(undelivered(err, series))
+	}
+}
+
+// undelivered returns the series PostSeries didn't manage to deliver, given
+// the error it returned for the full series slice that was posted. A
+// *MultiError reports exactly which chunks failed via its Failed field; any
+// other error is treated as a total failure of the post, so nothing is lost
+// by re-buffering too little.
+func undelivered(err error, series []*Series) []*Series {
+	if me, ok := err.(*MultiError); ok {
+		return me.Failed
+	}
+	return series
+}
+
+// takeBuffered returns and clears the series left over from a failed tick.
+func (mr *MetricsReporter) takeBuffered() []*Series {
+	mr.bufferMu.Lock()
+	defer mr.bufferMu.Unlock()
+
+	buffered := mr.buffered
+	mr.buffered = nil
+	return buffered
+}
+
+// buffer stashes series for the next tick to retry, keeping only the most
+// recent `maxBufferedSeries` (or `DefaultMaxBufferedSeries`, if unset) so a
+// prolonged outage can't grow the buffer without bound.
+func (mr *MetricsReporter) buffer(series []*Series) {
+	mr.bufferMu.Lock()
+	defer mr.bufferMu.Unlock()
+
+	max := mr.maxBufferedSeries
+	if max <= 0 {
+		max = DefaultMaxBufferedSeries
+	}
+	if len(series) > max {
+		series = series[len(series)-max:]
+	}
+	mr.buffered = series
+}
+
+// UseStatsd switches this reporter to emit metrics as DogStatsD lines over sc
+// instead of POSTing JSON series to the HTTP API, avoiding the per-report
+// round trip. It returns the receiver so it can be chained off `Reporter`.
+func (mr *MetricsReporter) UseStatsd(sc *StatsdClient) *MetricsReporter {
+	mr.statsd = sc
+	return mr
+}
+
+// WithNamespace prepends "prefix." to every metric name this reporter emits,
+// so multiple reporters in the same process can be told apart (e.g.
+// "api." vs "worker."). It returns the receiver so it can be chained off
+// `Reporter`.
+func (mr *MetricsReporter) WithNamespace(prefix string) *MetricsReporter {
+	mr.namespace = prefix + "."
+	return mr
+}
+
+// WithGlobalTags attaches tags to every series and service check this
+// reporter emits, in addition to any tags parsed from the metric name
+// itself (or returned by a `WithTagExtractor`). It returns the receiver so
+// it can be chained off `Reporter`.
+func (mr *MetricsReporter) WithGlobalTags(tags ...string) *MetricsReporter {
+	mr.globalTags = append(mr.globalTags, tags...)
+	return mr
+}
+
+// WithHost overrides the host attached to this reporter's series and
+// service checks, instead of the `Client`'s own `Host`. This is useful when
+// one process runs several reporters that should each appear as a
+// different host or service in Datadog. It returns the receiver so it can
+// be chained off `Reporter`.
+func (mr *MetricsReporter) WithHost(host string) *MetricsReporter {
+	mr.host = host
+	return mr
+}
+
+// WithTagExtractor overrides the default `name[tag1:v1,tag2:v2]` convention
+// for pulling tags out of a registered metric's name. f is given the raw
+// name passed to `metrics.Registry.Register` and should return the metric
+// name Datadog will display and its tags. It returns the receiver so it can
+// be chained off `Reporter`.
+func (mr *MetricsReporter) WithTagExtractor(
+	f func(name string) (string, []string)) *MetricsReporter {
+	mr.tagExtractor = f
+	return mr
+}
+
+// nameAndTags splits a registered metric's name into the name and tags
+// Datadog will see, honoring `WithTagExtractor` if configured, then applies
+// this reporter's namespace and global tags.
+func (mr *MetricsReporter) nameAndTags(id string) (string, []string) {
+	extract := splitNameAndTags
+	if mr.tagExtractor != nil {
+		extract = mr.tagExtractor
 	}
+	name, tags := extract(id)
+	return mr.namespace + name, mergeTags(mr.globalTags, tags)
 }
 
-// POST a single series report to the Datadog API. A 200 or 202 is expected for
-// this to complete without error.
+// effectiveHost returns the host attached to emitted series and service
+// checks: this reporter's own `WithHost` override, if set, or else the
+// `Client`'s host.
+func (mr *MetricsReporter) effectiveHost() string {
+	if mr.host != "" {
+		return mr.host
+	}
+	return mr.client.Host
+}
+
+// Report a single round of metrics to Datadog. If `UseStatsd` has been
+// called, this submits DogStatsD lines over the configured `StatsdClient`;
+// otherwise it POSTs a JSON series report to the HTTP API. A 200 or 202 is
+// expected from the HTTP API for this to complete without error.
 func (mr *MetricsReporter) Report() error {
+	if mr.statsd != nil {
+		return mr.reportStatsd()
+	}
 	return mr.client.PostSeries(mr.Series())
 }
 
+// For each metric associated with the current Registry, submit it to the
+// configured `StatsdClient` as one or more DogStatsD lines. The first error
+// encountered is returned, but remaining metrics are still reported.
+func (mr *MetricsReporter) reportStatsd() error {
+	var reportErr error
+	mr.registry.Each(func(id string, metric interface{}) {
+		name, tags := mr.nameAndTags(id)
+		if err := mr.statsdSeries(id, name, tags, metric); err != nil && reportErr == nil {
+			reportErr = err
+		}
+	})
+	return reportErr
+}
+
+// Switch through the known types of meters, submitting each to `mr.statsd`.
+// Counters are sent as `c` deltas since the last flush, gauges as `g`, and
+// histograms as batches of `h` samples drained from the underlying
+// `metrics.Sample`. Timers are not sent as individual `ms` samples; they are
+// reported as a count plus min/mean/percentile/max gauges in milliseconds
+// (see `statsdTiming`). id is the metric's raw registry key, used to
+// track per-metric state (see `meterDelta`) across flushes.
+func (mr *MetricsReporter) statsdSeries(
+	id, name string, tags []string, i interface{}) error {
+	switch m := i.(type) {
+	case metrics.Counter:
+		count := m.Count()
+		m.Clear()
+		return mr.statsd.Count(name, count, tags...)
+	case metrics.Gauge:
+		return mr.statsd.Gauge(name, float64(m.Value()), tags...)
+	case metrics.Healthcheck:
+		// TODO: Not implemented
+	case metrics.Histogram:
+		for _, v := range m.Sample().Values() {
+			if err := mr.statsd.Histogram(name, float64(v), tags...); err != nil {
+				return err
+			}
+		}
+		m.Clear()
+	case metrics.Meter:
+		return mr.statsd.Count(name, mr.meterDelta(id, m.Count()), tags...)
+	case metrics.Timer:
+		return mr.statsdTiming(name, tags, m)
+	}
+	return nil
+}
+
+// meterDelta returns how much a meter registered under id has grown since
+// the last call for that id, and records count as the new baseline.
+// `metrics.Meter` has no way to clear or reset its cumulative count, so
+// unlike `statsd.Counter` this is the only way to report it as a per-flush
+// delta instead of resubmitting its ever-growing lifetime total.
+func (mr *MetricsReporter) meterDelta(id string, count int64) int64 {
+	mr.meterCountMu.Lock()
+	defer mr.meterCountMu.Unlock()
+
+	if mr.lastMeterCount == nil {
+		mr.lastMeterCount = make(map[string]int64)
+	}
+	delta := count - mr.lastMeterCount[id]
+	mr.lastMeterCount[id] = count
+	return delta
+}
+
+// Timer exposes no way to drain or clear its underlying sample, so unlike
+// the histogram case in statsdSeries this reports the timer's lifetime
+// percentiles as gauges rather than replaying each raw sample.
+func (mr *MetricsReporter) statsdTiming(
+	name string, tags []string, m metrics.Timer) error {
+	ps := m.Percentiles([]float64{0.5, 0.95, 0.99})
+	if err := mr.statsd.Count(name+".count", m.Count(), tags...); err != nil {
+		return err
+	}
+	if err := mr.statsd.Gauge(name+".min", millisI(m.Min()), tags...); err != nil {
+		return err
+	}
+	if err := mr.statsd.Gauge(name+".mean", millisF(m.Mean()), tags...); err != nil {
+		return err
+	}
+	if err := mr.statsd.Gauge(name+".percentile.50", millisF(ps[0]), tags...); err != nil {
+		return err
+	}
+	if err := mr.statsd.Gauge(name+".percentile.95", millisF(ps[1]), tags...); err != nil {
+		return err
+	}
+	if err := mr.statsd.Gauge(name+".percentile.99", millisF(ps[2]), tags...); err != nil {
+		return err
+	}
+	return mr.statsd.Gauge(name+".max", millisI(m.Max()), tags...)
+}
+
 // For each metric assocaited with the current Registry, convert it to a
-// `Series` message, and return them all as a single array. The series messages
-// will have the current hostname of the `Client`.
+// `Series` message, and return them all as a single array. The series
+// messages will carry this reporter's host (see `WithHost`), defaulting to
+// the `Client`'s own hostname.
 func (mr *MetricsReporter) Series() []*Series {
 	now := time.Now().Unix()
 	series := make([]*Series, 0)
@@ -73,20 +329,55 @@ func (mr *MetricsReporter) series(t int64, name string, i interface{}) []*Series
 	case metrics.Gauge:
 		return mr.gaugeSeries(t, name, m)
 	case metrics.Healthcheck:
-		// TODO: Not implemented
+		mr.reportHealthcheck(name, m)
 	case metrics.Histogram:
 		return mr.histogramSeries(t, name, m)
 	case metrics.Meter:
 		return mr.meterSeries(t, name, m)
 	case metrics.Timer:
 		return mr.timerSeries(t, name, m)
+	case *ResettingTimer:
+		return mr.resettingTimerSeries(t, name, m)
 	}
 	return nil
 }
 
+// Healthchecks don't produce time series points. Instead, this runs the
+// check and posts its result to Datadog as a service check, logging any
+// delivery error the way `Start` does for series errors.
+func (mr *MetricsReporter) reportHealthcheck(id string, hc metrics.Healthcheck) {
+	if err := mr.client.PostServiceCheck(mr.serviceCheck(id, hc)); err != nil {
+		log.Printf("Datadog service check error: %s", err.Error())
+	}
+}
+
+// Runs the Healthcheck and builds the `ServiceCheck` Datadog would record
+// for its current state: a nil error maps to `StatusOk`, any other error
+// maps to `StatusCritical` with the error's message attached. The check name
+// is the metric name, honoring `nameAndTags`.
+func (mr *MetricsReporter) serviceCheck(id string, hc metrics.Healthcheck) *ServiceCheck {
+	name, tags := mr.nameAndTags(id)
+	hc.Check()
+
+	status := StatusOk
+	message := ""
+	if err := hc.Error(); err != nil {
+		status = StatusCritical
+		message = err.Error()
+	}
+
+	return &ServiceCheck{
+		Check:    name,
+		HostName: mr.effectiveHost(),
+		Status:   status,
+		Message:  message,
+		Tags:     tags,
+	}
+}
+
 func (mr *MetricsReporter) counterSeries(t int64, id string,
 	counter metrics.Counter) []*Series {
-	name, tags := splitNameAndTags(id)
+	name, tags := mr.nameAndTags(id)
 	counter.Inc(0)
 	return []*Series{
 		mr.counterI(name+".count", t, counter.Count(), tags),
@@ -95,7 +386,7 @@ func (mr *MetricsReporter) counterSeries(t int64, id string,
 
 func (mr *MetricsReporter) gaugeSeries(t int64, id string,
 	gauge metrics.Gauge) []*Series {
-	name, tags := splitNameAndTags(id)
+	name, tags := mr.nameAndTags(id)
 	return []*Series{
 		mr.gaugeI(name+".value", t, gauge.Value(), tags),
 	}
@@ -104,7 +395,7 @@ func (mr *MetricsReporter) gaugeSeries(t int64, id string,
 func (mr *MetricsReporter) histogramSeries(t int64, id string,
 	h metrics.Histogram) []*Series {
 	ps := h.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999})
-	name, tags := splitNameAndTags(id)
+	name, tags := mr.nameAndTags(id)
 
 	return []*Series{
 		mr.counterI(name+".count", t, h.Count(), tags),
@@ -122,7 +413,7 @@ func (mr *MetricsReporter) histogramSeries(t int64, id string,
 
 func (mr *MetricsReporter) meterSeries(t int64, id string,
 	m metrics.Meter) []*Series {
-	name, tags := splitNameAndTags(id)
+	name, tags := mr.nameAndTags(id)
 	m.Mark(0)
 	return []*Series{
 		mr.counterI(name+".count", t, m.Count(), tags),
@@ -136,7 +427,7 @@ func (mr *MetricsReporter) meterSeries(t int64, id string,
 func (mr *MetricsReporter) timerSeries(t int64, id string,
 	m metrics.Timer) []*Series {
 	ps := m.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999})
-	name, tags := splitNameAndTags(id)
+	name, tags := mr.nameAndTags(id)
 
 	return []*Series{
 		mr.counterI(name+".count", t, m.Count(), tags),
@@ -156,6 +447,58 @@ func (mr *MetricsReporter) timerSeries(t int64, id string,
 	}
 }
 
+// resettingTimerSeries reports the durations rt has recorded since the
+// previous call to Report, using nearest-rank percentiles over a sorted
+// copy of the buffer, then clears it.
+func (mr *MetricsReporter) resettingTimerSeries(t int64, id string,
+	rt *ResettingTimer) []*Series {
+	name, tags := mr.nameAndTags(id)
+	samples := rt.snapshot()
+
+	if len(samples) == 0 {
+		return []*Series{mr.counterI(name+".count", t, 0, tags)}
+	}
+
+	sorted := make([]int64, len(samples))
+	copy(sorted, samples)
+	sort.Sort(int64Slice(sorted))
+
+	var sum int64
+	for _, v := range sorted {
+		sum += v
+	}
+	mean := float64(sum) / float64(len(sorted))
+
+	return []*Series{
+		mr.counterI(name+".count", t, int64(len(samples)), tags),
+		mr.counterF(name+".min", t, millisI(sorted[0]), tags),
+		mr.counterF(name+".mean", t, millisF(mean), tags),
+		mr.counterF(name+".percentile.50", t, millisI(nearestRank(sorted, 0.5)), tags),
+		mr.counterF(name+".percentile.95", t, millisI(nearestRank(sorted, 0.95)), tags),
+		mr.counterF(name+".percentile.99", t, millisI(nearestRank(sorted, 0.99)), tags),
+		mr.counterF(name+".max", t, millisI(sorted[len(sorted)-1]), tags),
+	}
+}
+
+// nearestRank returns the pth percentile of sorted, which must already be
+// sorted ascending, using the nearest-rank method (idx = ceil(p*n) - 1).
+func nearestRank(sorted []int64, p float64) int64 {
+	idx := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 // `time.Duration` objects are always stored in nanoseconds. Here, we'll cast to
 // floating point milliseconds to ease of understanding what's going on from the
 // UI.
@@ -191,7 +534,7 @@ func (mr *MetricsReporter) seriesF(
 		Metric: metric,
 		Points: [][2]interface{}{[2]interface{}{t, v}},
 		Type:   typ,
-		Host:   mr.client.Host,
+		Host:   mr.effectiveHost(),
 		Tags:   tags,
 	}
 }
@@ -202,7 +545,7 @@ func (mr *MetricsReporter) seriesI(
 		Metric: metric,
 		Points: [][2]interface{}{[2]interface{}{t, v}},
 		Type:   typ,
-		Host:   mr.client.Host,
+		Host:   mr.effectiveHost(),
 		Tags:   tags,
 	}
 }
@@ -1,11 +1,38 @@
 package datadog
 
 import (
+	"fmt"
 	"github.com/rcrowley/go-metrics"
+	"io/ioutil"
 	. "launchpad.net/gocheck"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
 	"time"
 )
 
+// redirectingClient returns an *http.Client that rewrites every outgoing
+// request to target, regardless of the URL it was built for. This lets
+// tests exercise PostSeries's real URL-building code while still hitting a
+// local httptest.Server.
+func redirectingClient(target string) *http.Client {
+	targetUrl, err := url.Parse(target)
+	if err != nil {
+		panic(err)
+	}
+	return &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		req.URL.Scheme = targetUrl.Scheme
+		req.URL.Host = targetUrl.Host
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
 type ReporterSuite struct{}
 
 var (
@@ -22,7 +49,7 @@ func (s *ReporterSuite) SetUpTest(c *C) {
 	client = &Client{
 		Host: "My Host",
 	}
-	reporter = &MetricsReporter{client, registry}
+	reporter = &MetricsReporter{client: client, registry: registry}
 	t = time.Now()
 }
 
@@ -78,7 +105,26 @@ func (_ *ReporterSuite) TestGaugeSeries(c *C) {
 }
 
 func (_ *ReporterSuite) TestHealthcheckSeries(c *C) {
-	c.Skip("Healthchecks presently not impelented")
+	hc := metrics.NewHealthcheck(func(h metrics.Healthcheck) {
+		h.Unhealthy(fmt.Errorf("connection refused"))
+	})
+
+	sc := reporter.serviceCheck("my.health[env:prod]", hc)
+	c.Check(sc.Check, Equals, "my.health")
+	c.Check(sc.HostName, Equals, "My Host")
+	c.Check(sc.Status, Equals, StatusCritical)
+	c.Check(sc.Message, Equals, "connection refused")
+	c.Check(sc.Tags, DeepEquals, []string{"env:prod"})
+}
+
+func (_ *ReporterSuite) TestHealthyHealthcheckSeries(c *C) {
+	hc := metrics.NewHealthcheck(func(h metrics.Healthcheck) {
+		h.Healthy()
+	})
+
+	sc := reporter.serviceCheck("my.health", hc)
+	c.Check(sc.Status, Equals, StatusOk)
+	c.Check(sc.Message, Equals, "")
 }
 
 func (_ *ReporterSuite) TestHistogramSeries(c *C) {
@@ -155,3 +201,200 @@ func (_ *ReporterSuite) TestTimerSeries(c *C) {
 
 	c.Check(series[2].Metric, Equals, "my.timer.max")
 }
+
+func (s *ReporterSuite) TestReportUsesStatsdWhenConfigured(c *C) {
+	laddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	conn, err := net.ListenUDP("udp", laddr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	sc, err := NewStatsdClient(conn.LocalAddr().String(),
+		WithFlushInterval(time.Hour))
+	c.Assert(err, IsNil)
+	defer sc.Close()
+
+	c.Check(reporter.UseStatsd(sc), Equals, reporter)
+
+	counter := metrics.NewCounter()
+	counter.Inc(666)
+	registry.Register("my.counter", counter)
+
+	c.Assert(reporter.Report(), IsNil)
+	c.Assert(sc.Flush(), IsNil)
+
+	buf := make([]byte, DefaultUDPBufferSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	c.Assert(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "my.counter:666|c")
+}
+
+func (s *ReporterSuite) TestReportStatsdMeterSendsDeltaNotLifetimeCount(c *C) {
+	laddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	conn, err := net.ListenUDP("udp", laddr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	sc, err := NewStatsdClient(conn.LocalAddr().String(),
+		WithFlushInterval(time.Hour))
+	c.Assert(err, IsNil)
+	defer sc.Close()
+
+	reporter.UseStatsd(sc)
+
+	meter := metrics.NewMeter()
+	meter.Mark(10)
+	registry.Register("my.meter", meter)
+
+	buf := make([]byte, DefaultUDPBufferSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	c.Assert(reporter.Report(), IsNil)
+	c.Assert(sc.Flush(), IsNil)
+	n, err := conn.Read(buf)
+	c.Assert(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "my.meter:10|c")
+
+	meter.Mark(10)
+	c.Assert(reporter.Report(), IsNil)
+	c.Assert(sc.Flush(), IsNil)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = conn.Read(buf)
+	c.Assert(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "my.meter:10|c")
+}
+
+func (_ *ReporterSuite) TestNamespaceAndGlobalTagsAreApplied(c *C) {
+	reporter.WithNamespace("myapp").WithGlobalTags("env:prod", "service:api")
+
+	gauge := metrics.NewGauge()
+	gauge.Update(42)
+
+	series := reporter.series(t.Unix(), "my.gauge[host:a]", gauge)
+	c.Check(series, HasLen, 1)
+	c.Check(series[0].Metric, Equals, "myapp.my.gauge.value")
+	c.Check(series[0].Tags, DeepEquals, []string{"env:prod", "service:api", "host:a"})
+}
+
+func (_ *ReporterSuite) TestWithHostOverridesClientHost(c *C) {
+	c.Check(reporter.WithHost("override-host"), Equals, reporter)
+
+	gauge := metrics.NewGauge()
+	gauge.Update(42)
+
+	series := reporter.series(t.Unix(), "my.gauge", gauge)
+	c.Check(series[0].Host, Equals, "override-host")
+}
+
+func (_ *ReporterSuite) TestWithTagExtractorOverridesDefaultParsing(c *C) {
+	reporter.WithTagExtractor(func(name string) (string, []string) {
+		return "extracted", []string{"source:extractor"}
+	})
+
+	gauge := metrics.NewGauge()
+	gauge.Update(42)
+
+	series := reporter.series(t.Unix(), "my.gauge[host:a]", gauge)
+	c.Check(series[0].Metric, Equals, "extracted.value")
+	c.Check(series[0].Tags, DeepEquals, []string{"source:extractor"})
+}
+
+func (_ *ReporterSuite) TestResettingTimerSeries(c *C) {
+	rt := NewResettingTimer()
+	for _, ms := range []int64{1, 2, 4, 8, 16} {
+		rt.Update(time.Duration(ms) * time.Millisecond)
+	}
+
+	series := reporter.series(t.Unix(), "my.rtimer", rt)
+	c.Check(series, HasLen, 7)
+
+	c.Check(series[0].Metric, Equals, "my.rtimer.count")
+	c.Check(series[0].Points[0][1], Equals, int64(5))
+
+	c.Check(series[1].Metric, Equals, "my.rtimer.min")
+	c.Check(series[1].Points[0][1], Equals, float64(1))
+
+	c.Check(series[2].Metric, Equals, "my.rtimer.mean")
+	c.Check(series[2].Points[0][1], Equals, 6.2)
+
+	c.Check(series[3].Metric, Equals, "my.rtimer.percentile.50")
+	c.Check(series[3].Points[0][1], Equals, float64(4))
+
+	c.Check(series[4].Metric, Equals, "my.rtimer.percentile.95")
+	c.Check(series[4].Points[0][1], Equals, float64(16))
+
+	c.Check(series[5].Metric, Equals, "my.rtimer.percentile.99")
+	c.Check(series[5].Points[0][1], Equals, float64(16))
+
+	c.Check(series[6].Metric, Equals, "my.rtimer.max")
+	c.Check(series[6].Points[0][1], Equals, float64(16))
+
+	// The buffer is cleared after each report.
+	c.Check(reporter.series(t.Unix(), "my.rtimer", rt)[0].Points[0][1], Equals, int64(0))
+}
+
+func (s *ReporterSuite) TestReportTickReBuffersSeriesOnFailure(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client.HTTPClient = redirectingClient(server.URL)
+	client.MaxRetries = 0
+
+	counter := metrics.NewCounter()
+	counter.Inc(1)
+	registry.Register("my.counter", counter)
+
+	reporter.reportTick()
+	c.Check(reporter.takeBuffered(), Not(HasLen), 0)
+}
+
+func (s *ReporterSuite) TestReportTickMergesBufferedSeriesIntoNextReport(c *C) {
+	var attempts int32
+	var lastBodyLen int
+
+	// The first tick's two attempts (MaxRetries == 1) both fail, so its
+	// series is buffered; the second tick's first attempt succeeds.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&attempts, 1)
+		if n <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		lastBodyLen = len(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client.HTTPClient = redirectingClient(server.URL)
+	client.MaxRetries = 1
+
+	counter := metrics.NewCounter()
+	counter.Inc(1)
+	registry.Register("my.counter", counter)
+
+	reporter.reportTick()
+	reporter.reportTick()
+
+	c.Check(reporter.takeBuffered(), HasLen, 0)
+	c.Check(lastBodyLen > 0, Equals, true)
+}
+
+func (s *ReporterSuite) TestBufferTrimsToMaxBufferedSeries(c *C) {
+	reporter.WithMaxBufferedSeries(2)
+	series := []*Series{
+		{Metric: "one"},
+		{Metric: "two"},
+		{Metric: "three"},
+	}
+	reporter.buffer(series)
+
+	buffered := reporter.takeBuffered()
+	c.Check(buffered, HasLen, 2)
+	c.Check(buffered[0].Metric, Equals, "two")
+	c.Check(buffered[1].Metric, Equals, "three")
+}
@@ -0,0 +1,31 @@
+package datadog
+
+import "strings"
+
+// MultiError collects the errors from posting several independent chunks of
+// a single report, so one chunk's failure doesn't suppress the others'.
+// Failed holds the series belonging to the chunks that produced those
+// errors, so a caller like MetricsReporter can retry exactly what didn't
+// get delivered instead of the whole report.
+type MultiError struct {
+	Errors []error
+	Failed []*Series
+}
+
+func (e *MultiError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ErrorOrNil returns e if it holds any errors, or nil otherwise. Use this
+// instead of returning e directly, since a non-nil *MultiError with zero
+// Errors would still compare non-nil to callers checking `err != nil`.
+func (e *MultiError) ErrorOrNil() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,25 @@
+package datadog
+
+import (
+	"fmt"
+	. "launchpad.net/gocheck"
+)
+
+type MultiErrorSuite struct{}
+
+var _ = Suite(&MultiErrorSuite{})
+
+func (s *MultiErrorSuite) TestErrorOrNilReturnsNilWhenEmpty(c *C) {
+	err := &MultiError{}
+	c.Check(err.ErrorOrNil(), IsNil)
+}
+
+func (s *MultiErrorSuite) TestErrorOrNilReturnsSelfWhenNonEmpty(c *C) {
+	err := &MultiError{Errors: []error{fmt.Errorf("boom")}}
+	c.Check(err.ErrorOrNil(), Equals, error(err))
+}
+
+func (s *MultiErrorSuite) TestErrorJoinsMessages(c *C) {
+	err := &MultiError{Errors: []error{fmt.Errorf("one"), fmt.Errorf("two")}}
+	c.Check(err.Error(), Equals, "one; two")
+}
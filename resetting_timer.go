@@ -0,0 +1,73 @@
+package datadog
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// resettingTimerReservoirSize caps the number of durations a ResettingTimer
+// holds between reports. Once full, new samples replace an existing one at
+// random, so percentiles stay representative without unbounded memory
+// growth.
+const resettingTimerReservoirSize = 8192
+
+// ResettingTimer records durations seen since the last call to snapshot,
+// then clears its buffer. Unlike `metrics.Timer`, whose percentiles are
+// EWMA-weighted over the metric's lifetime, ResettingTimer's percentiles
+// describe only the most recent reporting interval, which is what
+// Datadog's `as_rate` and burst-latency dashboards expect. Register it with
+// a `metrics.Registry` alongside the standard go-metrics types; `(*MetricsReporter).series`
+// recognizes it and reports `<name>.count`, `<name>.min`, `<name>.mean`,
+// `<name>.percentile.{50,95,99}`, and `<name>.max` in milliseconds.
+type ResettingTimer struct {
+	mu      sync.Mutex
+	samples []int64
+	count   int64
+}
+
+// NewResettingTimer constructs a ResettingTimer ready for registration with
+// a metrics.Registry.
+func NewResettingTimer() *ResettingTimer {
+	return &ResettingTimer{
+		samples: make([]int64, 0, resettingTimerReservoirSize),
+	}
+}
+
+// Update records a duration. Once the buffer reaches resettingTimerReservoirSize,
+// each further sample replaces a random existing sample with probability
+// resettingTimerReservoirSize/n, where n counts the samples seen since the
+// last snapshot, and is otherwise discarded; the buffer never grows past
+// that size.
+func (t *ResettingTimer) Update(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.count++
+	if len(t.samples) < resettingTimerReservoirSize {
+		t.samples = append(t.samples, int64(d))
+		return
+	}
+	if i := rand.Int63n(t.count); i < resettingTimerReservoirSize {
+		t.samples[i] = int64(d)
+	}
+}
+
+// Time records the duration of calling f.
+func (t *ResettingTimer) Time(f func()) {
+	start := time.Now()
+	f()
+	t.Update(time.Since(start))
+}
+
+// snapshot returns the samples recorded since the previous snapshot and
+// clears the buffer.
+func (t *ResettingTimer) snapshot() []int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	samples := t.samples
+	t.samples = make([]int64, 0, resettingTimerReservoirSize)
+	t.count = 0
+	return samples
+}
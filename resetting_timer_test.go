@@ -0,0 +1,40 @@
+package datadog
+
+import (
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type ResettingTimerSuite struct{}
+
+var _ = Suite(&ResettingTimerSuite{})
+
+func (s *ResettingTimerSuite) TestSnapshotReturnsAndClearsSamples(c *C) {
+	rt := NewResettingTimer()
+	rt.Update(1 * time.Millisecond)
+	rt.Update(2 * time.Millisecond)
+
+	samples := rt.snapshot()
+	c.Check(samples, HasLen, 2)
+	c.Check(rt.snapshot(), HasLen, 0)
+}
+
+func (s *ResettingTimerSuite) TestTimeRecordsDuration(c *C) {
+	rt := NewResettingTimer()
+	rt.Time(func() {
+		time.Sleep(5 * time.Millisecond)
+	})
+
+	samples := rt.snapshot()
+	c.Check(samples, HasLen, 1)
+	c.Check(samples[0] >= int64(5*time.Millisecond), Equals, true)
+}
+
+func (s *ResettingTimerSuite) TestReservoirCapsBuffer(c *C) {
+	rt := NewResettingTimer()
+	for i := 0; i < resettingTimerReservoirSize+10; i++ {
+		rt.Update(time.Duration(i) * time.Millisecond)
+	}
+
+	c.Check(len(rt.snapshot()), Equals, resettingTimerReservoirSize)
+}
@@ -0,0 +1,275 @@
+package datadog
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultUDPBufferSize is the largest packet StatsdClient will send over
+	// a UDP connection before flushing, chosen to stay under the common
+	// Ethernet MTU once IP/UDP headers are accounted for.
+	DefaultUDPBufferSize = 1432
+
+	// DefaultUDSBufferSize is the largest packet StatsdClient will send over
+	// a Unix domain socket before flushing.
+	DefaultUDSBufferSize = 8192
+
+	// DefaultFlushInterval is how often a StatsdClient flushes its buffer
+	// even if it hasn't filled up.
+	DefaultFlushInterval = 2 * time.Second
+)
+
+// StatsdClient speaks the DogStatsD line protocol
+// (metric.name:value|type|@sample_rate|#tag1:v1,tag2:v2) over UDP or a Unix
+// domain socket to a local dogstatsd agent. This lets callers on EC2, ECS, or
+// Kubernetes hosts avoid the per-report HTTPS round trip that Client.PostSeries
+// requires.
+type StatsdClient struct {
+	conn net.Conn
+
+	mu            sync.Mutex
+	buf           bytes.Buffer
+	maxPacketSize int
+
+	namespace    string
+	tags         []string
+	errorHandler func(error)
+
+	flushInterval time.Duration
+	flushTicker   *time.Ticker
+	done          chan struct{}
+}
+
+// Option configures a StatsdClient. See NewStatsdClient.
+type Option func(*StatsdClient)
+
+// WithBufferSize overrides the maximum number of bytes StatsdClient will
+// buffer before flushing a packet. It defaults to DefaultUDPBufferSize for
+// UDP connections and DefaultUDSBufferSize for Unix domain sockets.
+func WithBufferSize(n int) Option {
+	return func(sc *StatsdClient) { sc.maxPacketSize = n }
+}
+
+// WithFlushInterval overrides how often StatsdClient flushes its buffer even
+// if it hasn't filled up. It defaults to DefaultFlushInterval.
+func WithFlushInterval(d time.Duration) Option {
+	return func(sc *StatsdClient) { sc.flushInterval = d }
+}
+
+// WithGlobalTags attaches tags to every metric and event sent by this
+// client, in addition to any tags passed to the individual call.
+func WithGlobalTags(tags ...string) Option {
+	return func(sc *StatsdClient) { sc.tags = append(sc.tags, tags...) }
+}
+
+// WithNamespace prepends "prefix." to every metric name sent by this client.
+func WithNamespace(prefix string) Option {
+	return func(sc *StatsdClient) { sc.namespace = prefix + "." }
+}
+
+// WithErrorHandler registers a callback invoked whenever a write to the
+// dogstatsd agent fails. Whether or not one is set, the error is also
+// returned from Flush or from the metric call whose write triggered the
+// flush; errors from the periodic background flush and from the final flush
+// in Close are otherwise dropped.
+func WithErrorHandler(h func(error)) Option {
+	return func(sc *StatsdClient) { sc.errorHandler = h }
+}
+
+// NewStatsdClient dials addr, which may be a "host:port" UDP address or the
+// path to a Unix domain socket (optionally prefixed with "unix://"), and
+// returns a StatsdClient ready to submit metrics to a local dogstatsd agent.
+// The client buffers lines and flushes them periodically and whenever the
+// next line would push the current packet over its configured MTU.
+func NewStatsdClient(addr string, opts ...Option) (*StatsdClient, error) {
+	network := "udp"
+	if strings.HasPrefix(addr, "unix://") {
+		network = "unixgram"
+		addr = strings.TrimPrefix(addr, "unix://")
+	} else if strings.HasPrefix(addr, "/") {
+		network = "unixgram"
+	}
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &StatsdClient{
+		conn:          conn,
+		flushInterval: DefaultFlushInterval,
+		done:          make(chan struct{}),
+	}
+	if network == "unixgram" {
+		sc.maxPacketSize = DefaultUDSBufferSize
+	} else {
+		sc.maxPacketSize = DefaultUDPBufferSize
+	}
+	for _, opt := range opts {
+		opt(sc)
+	}
+
+	sc.flushTicker = time.NewTicker(sc.flushInterval)
+	go sc.flushLoop()
+	return sc, nil
+}
+
+func (sc *StatsdClient) flushLoop() {
+	for {
+		select {
+		case <-sc.flushTicker.C:
+			sc.Flush()
+		case <-sc.done:
+			return
+		}
+	}
+}
+
+// Close stops the background flush loop, flushes any buffered metrics, and
+// closes the underlying connection.
+func (sc *StatsdClient) Close() error {
+	sc.flushTicker.Stop()
+	close(sc.done)
+	sc.Flush()
+	return sc.conn.Close()
+}
+
+// Count submits a counter metric with the given delta.
+func (sc *StatsdClient) Count(name string, value int64, tags ...string) error {
+	return sc.send(name, strconv.FormatInt(value, 10), "c", tags)
+}
+
+// Gauge submits a gauge metric with the given value.
+func (sc *StatsdClient) Gauge(name string, value float64, tags ...string) error {
+	return sc.send(name, formatFloat(value), "g", tags)
+}
+
+// Histogram submits a histogram sample.
+func (sc *StatsdClient) Histogram(name string, value float64, tags ...string) error {
+	return sc.send(name, formatFloat(value), "h", tags)
+}
+
+// Timing submits a timing sample, reported to dogstatsd in milliseconds.
+func (sc *StatsdClient) Timing(name string, d time.Duration, tags ...string) error {
+	ms := float64(d) / float64(time.Millisecond)
+	return sc.send(name, formatFloat(ms), "ms", tags)
+}
+
+// Distribution submits a distribution sample.
+func (sc *StatsdClient) Distribution(name string, value float64, tags ...string) error {
+	return sc.send(name, formatFloat(value), "d", tags)
+}
+
+// Set records value as having occurred for the named set, which dogstatsd
+// uses to count unique occurrences.
+func (sc *StatsdClient) Set(name, value string, tags ...string) error {
+	return sc.send(name, value, "s", tags)
+}
+
+func (sc *StatsdClient) send(name, value, typ string, tags []string) error {
+	var line bytes.Buffer
+	line.WriteString(sc.namespace)
+	line.WriteString(name)
+	line.WriteByte(':')
+	line.WriteString(value)
+	line.WriteByte('|')
+	line.WriteString(typ)
+	if all := mergeTags(sc.tags, tags); len(all) > 0 {
+		line.WriteString("|#")
+		line.WriteString(strings.Join(all, ","))
+	}
+	return sc.write(line.Bytes())
+}
+
+// Event submits e to the local dogstatsd agent using its "_e" event line
+// format.
+func (sc *StatsdClient) Event(e *Event) error {
+	title := strings.Replace(e.Title, "\n", "\\n", -1)
+	text := strings.Replace(e.Text, "\n", "\\n", -1)
+
+	var line bytes.Buffer
+	fmt.Fprintf(&line, "_e{%d,%d}:%s|%s", len(title), len(text), title, text)
+	if e.DateHappened != 0 {
+		fmt.Fprintf(&line, "|d:%d", e.DateHappened)
+	}
+	if e.Host != "" {
+		fmt.Fprintf(&line, "|h:%s", e.Host)
+	}
+	if e.AggregationKey != "" {
+		fmt.Fprintf(&line, "|k:%s", e.AggregationKey)
+	}
+	if e.SourceTypeName != "" {
+		fmt.Fprintf(&line, "|s:%s", e.SourceTypeName)
+	}
+	if e.Priority != "" {
+		fmt.Fprintf(&line, "|p:%s", e.Priority)
+	}
+	if e.AlertType != "" {
+		fmt.Fprintf(&line, "|t:%s", e.AlertType)
+	}
+	if tags := mergeTags(sc.tags, e.Tags); len(tags) > 0 {
+		line.WriteString("|#")
+		line.WriteString(strings.Join(tags, ","))
+	}
+	return sc.write(line.Bytes())
+}
+
+// write appends line to the current packet, flushing first if appending it
+// would push the packet over maxPacketSize.
+func (sc *StatsdClient) write(line []byte) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.buf.Len() > 0 && sc.buf.Len()+1+len(line) > sc.maxPacketSize {
+		if err := sc.flushLocked(); err != nil {
+			return err
+		}
+	}
+	if sc.buf.Len() > 0 {
+		sc.buf.WriteByte('\n')
+	}
+	sc.buf.Write(line)
+	return nil
+}
+
+// Flush writes any buffered metrics to the dogstatsd agent immediately.
+func (sc *StatsdClient) Flush() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.flushLocked()
+}
+
+func (sc *StatsdClient) flushLocked() error {
+	if sc.buf.Len() == 0 {
+		return nil
+	}
+	_, err := sc.conn.Write(sc.buf.Bytes())
+	sc.buf.Reset()
+	if err != nil && sc.errorHandler != nil {
+		sc.errorHandler(err)
+	}
+	return err
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func mergeTags(global, local []string) []string {
+	if len(global) == 0 {
+		return local
+	}
+	if len(local) == 0 {
+		return global
+	}
+	merged := make([]string, 0, len(global)+len(local))
+	merged = append(merged, global...)
+	merged = append(merged, local...)
+	return merged
+}
@@ -0,0 +1,101 @@
+package datadog
+
+import (
+	. "launchpad.net/gocheck"
+	"net"
+	"time"
+)
+
+type StatsdClientSuite struct {
+	conn *net.UDPConn
+	sc   *StatsdClient
+}
+
+var _ = Suite(&StatsdClientSuite{})
+
+func (s *StatsdClientSuite) SetUpTest(c *C) {
+	laddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	conn, err := net.ListenUDP("udp", laddr)
+	c.Assert(err, IsNil)
+	s.conn = conn
+
+	sc, err := NewStatsdClient(conn.LocalAddr().String(),
+		WithFlushInterval(time.Hour))
+	c.Assert(err, IsNil)
+	s.sc = sc
+}
+
+func (s *StatsdClientSuite) TearDownTest(c *C) {
+	s.sc.Close()
+	s.conn.Close()
+}
+
+func (s *StatsdClientSuite) readPacket(c *C) string {
+	buf := make([]byte, DefaultUDPBufferSize)
+	s.conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := s.conn.Read(buf)
+	c.Assert(err, IsNil)
+	return string(buf[:n])
+}
+
+func (s *StatsdClientSuite) TestCountLine(c *C) {
+	c.Assert(s.sc.Count("my.counter", 3, "tag:one"), IsNil)
+	c.Assert(s.sc.Flush(), IsNil)
+	c.Check(s.readPacket(c), Equals, "my.counter:3|c|#tag:one")
+}
+
+func (s *StatsdClientSuite) TestGaugeLine(c *C) {
+	c.Assert(s.sc.Gauge("my.gauge", 2.5), IsNil)
+	c.Assert(s.sc.Flush(), IsNil)
+	c.Check(s.readPacket(c), Equals, "my.gauge:2.5|g")
+}
+
+func (s *StatsdClientSuite) TestTimingLine(c *C) {
+	c.Assert(s.sc.Timing("my.timer", 23*time.Millisecond), IsNil)
+	c.Assert(s.sc.Flush(), IsNil)
+	c.Check(s.readPacket(c), Equals, "my.timer:23|ms")
+}
+
+func (s *StatsdClientSuite) TestGlobalAndPerCallTagsAreMerged(c *C) {
+	s.sc.tags = []string{"env:test"}
+	c.Assert(s.sc.Count("my.counter", 1, "host:a"), IsNil)
+	c.Assert(s.sc.Flush(), IsNil)
+	c.Check(s.readPacket(c), Equals, "my.counter:1|c|#env:test,host:a")
+}
+
+func (s *StatsdClientSuite) TestNamespaceIsPrepended(c *C) {
+	s.sc.namespace = "myapp."
+	c.Assert(s.sc.Count("my.counter", 1), IsNil)
+	c.Assert(s.sc.Flush(), IsNil)
+	c.Check(s.readPacket(c), Equals, "myapp.my.counter:1|c")
+}
+
+func (s *StatsdClientSuite) TestMultipleLinesShareOnePacket(c *C) {
+	c.Assert(s.sc.Count("one", 1), IsNil)
+	c.Assert(s.sc.Count("two", 2), IsNil)
+	c.Assert(s.sc.Flush(), IsNil)
+	c.Check(s.readPacket(c), Equals, "one:1|c\ntwo:2|c")
+}
+
+func (s *StatsdClientSuite) TestPacketFlushesWhenOverMTU(c *C) {
+	s.sc.maxPacketSize = 10
+	c.Assert(s.sc.Count("first", 1), IsNil)
+	c.Assert(s.sc.Count("second", 2), IsNil)
+	c.Check(s.readPacket(c), Equals, "first:1|c")
+	c.Assert(s.sc.Flush(), IsNil)
+	c.Check(s.readPacket(c), Equals, "second:2|c")
+}
+
+func (s *StatsdClientSuite) TestEventLine(c *C) {
+	e := &Event{
+		Title:     "deploy",
+		Text:      "line one\nline two",
+		AlertType: "info",
+		Tags:      []string{"service:api"},
+	}
+	c.Assert(s.sc.Event(e), IsNil)
+	c.Assert(s.sc.Flush(), IsNil)
+	c.Check(s.readPacket(c), Equals,
+		"_e{6,18}:deploy|line one\\nline two|t:info|#service:api")
+}